@@ -15,12 +15,20 @@
 package products
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/apigee/registry-experimental/cmd/registry-connect/discover/apigee/common"
 	"github.com/apigee/registry/cmd/registry/patch"
+	"github.com/apigee/registry/pkg/connection"
 	"github.com/apigee/registry/pkg/log"
 	"github.com/apigee/registry/pkg/models"
 	"github.com/apigee/registry/rpc"
@@ -33,7 +41,19 @@ import (
 // generated by GoReleaser.
 var Version = "dev"
 
+// options bundles the flags accepted by the products command.
+type options struct {
+	includeBundles  bool
+	bundleGCSBucket string
+	push            bool
+	project         string
+	dryRun          bool
+	stateFile       string
+	reconcile       bool
+}
+
 func Command() *cobra.Command {
+	opts := &options{}
 	var cmd = &cobra.Command{
 		Use:   "products",
 		Short: "Export Apigee Products",
@@ -41,14 +61,37 @@ func Command() *cobra.Command {
 		RunE: func(cmd *cobra.Command, args []string) (err error) {
 			ctx := cmd.Context()
 			org := args[0]
+			if opts.push && opts.project == "" {
+				return fmt.Errorf("--project is required with --push")
+			}
 			client := common.Client(org)
-			return exportProducts(ctx, client)
+			return exportProducts(ctx, client, opts)
 		},
 	}
+	cmd.Flags().BoolVar(&opts.includeBundles, "include-bundles", false,
+		"fetch the deployed proxy revision bundle for each deployment and attach it as an artifact")
+	cmd.Flags().StringVar(&opts.bundleGCSBucket, "bundle-gcs-bucket", "",
+		"upload proxy bundles to this GCS bucket instead of embedding them as base64, recording a gs:// URL and checksum")
+	cmd.Flags().BoolVar(&opts.push, "push", false,
+		"push the generated APIs, deployments, and artifacts directly into a registry project instead of printing yaml")
+	cmd.Flags().StringVar(&opts.project, "project", "",
+		"apigeeregistry project to push into, required with --push")
+	cmd.Flags().BoolVar(&opts.dryRun, "dry-run", false,
+		"with --push, print the yaml that would be pushed instead of applying it")
+	cmd.Flags().StringVar(&opts.stateFile, "state-file", "",
+		"path to a file recording the last-seen state of each product, proxy revision, and deployment, used to only re-emit what changed")
+	cmd.Flags().BoolVar(&opts.reconcile, "reconcile", false,
+		"with --push and --state-file, delete registry resources for products that disappeared from Apigee since the previous run")
 	return cmd
 }
 
-func exportProducts(ctx context.Context, client common.ApigeeClient) error {
+func exportProducts(ctx context.Context, client common.ApigeeClient, opts *options) error {
+	prevState, err := loadState(opts.stateFile)
+	if err != nil {
+		return err
+	}
+	currState := &state{Org: client.Org(), Products: map[string]*productState{}, PendingDeletions: prevState.PendingDeletions}
+
 	products, err := client.Products(ctx)
 	if err != nil {
 		return err
@@ -63,14 +106,40 @@ func exportProducts(ctx context.Context, client common.ApigeeClient) error {
 		proxyByName[p.Name] = p
 	}
 
+	proxyDeploymentHashes, err := deploymentHashesByProxy(ctx, client)
+	if err != nil {
+		return err
+	}
+
 	apis := []*models.Api{}
 	apisByProxy := map[string][]*models.Api{}
+	// knownProxies records every proxy bound to a product, including ones
+	// skipped below as unchanged, so addDeployments can tell a proxy with
+	// no api to attach to apart from one that's truly unbound.
+	knownProxies := map[string]bool{}
 	for _, p := range products {
 		product, err := client.Product(ctx, p.Name)
 		if err != nil {
 			return err
 		}
 
+		name := common.Label(product.Name)
+		boundTo := boundProxies(product)
+		for _, p := range boundTo {
+			knownProxies[p] = true
+		}
+		deploymentHashes := deploymentHashesForProxies(boundTo, proxyDeploymentHashes)
+
+		if prevProduct, seen := prevState.Products[name]; seen &&
+			prevProduct.LastModifiedAt == product.LastModifiedAt &&
+			equalDeploymentHashes(prevProduct.DeploymentHashes, deploymentHashes) {
+			// Unchanged since the last run; carry its state forward without
+			// re-emitting it.
+			currState.Products[name] = prevProduct
+			continue
+		}
+		currState.Products[name] = &productState{LastModifiedAt: product.LastModifiedAt, DeploymentHashes: deploymentHashes}
+
 		api := &models.Api{
 			Header: models.Header{
 				ApiVersion: patch.RegistryV1,
@@ -94,11 +163,10 @@ func exportProducts(ctx context.Context, client common.ApigeeClient) error {
 		}
 		apis = append(apis, api)
 
-		proxies := boundProxies(product)
-		if len(proxies) > 0 {
+		if len(boundTo) > 0 {
 			related := &rpc.ReferenceList{}
 			dependencies := &rpc.ReferenceList{}
-			for _, p := range proxies {
+			for _, p := range boundTo {
 				apisByProxy[p] = append(apisByProxy[p], api)
 
 				related.References = append(related.References, &rpc.ReferenceList_Reference{
@@ -146,25 +214,149 @@ func exportProducts(ctx context.Context, client common.ApigeeClient) error {
 		}
 	}
 
-	err = addDeployments(ctx, client, apisByProxy)
+	err = addDeployments(ctx, client, apisByProxy, knownProxies, opts, currState)
 	if err != nil {
 		return err
 	}
 
+	parent := registryParent(opts, client)
+	deletions := deletedApis(parent, prevState, currState)
+	deletions = append(deletions, deletedDeployments(parent, prevState, currState)...)
+	if opts.reconcile {
+		deletions = dedupStrings(append(deletions, prevState.PendingDeletions...))
+	}
+
+	if opts.push && !opts.dryRun {
+		failed, err := pushApis(ctx, opts.project, apis)
+		if err != nil {
+			return err
+		}
+		// A product whose push failed must not be recorded as seen at its
+		// new revision, or the unchanged-skip check above will treat it as
+		// already in sync and never retry it.
+		for name := range failed {
+			if prevProduct, ok := prevState.Products[name]; ok {
+				currState.Products[name] = prevProduct
+			} else {
+				delete(currState.Products, name)
+			}
+		}
+
+		if opts.reconcile && len(deletions) > 0 {
+			stillPending, err := deleteResources(ctx, opts.project, deletions)
+			if err != nil {
+				return err
+			}
+			currState.PendingDeletions = stillPending
+		}
+		return saveState(opts.stateFile, currState)
+	}
+
 	items := &struct {
 		ApiVersion string
 		Items      []*models.Api
+		Deletions  []string `yaml:"deletions,omitempty"`
 	}{
 		ApiVersion: patch.RegistryV1,
 		Items:      apis,
+		Deletions:  deletions,
 	}
+	if err := yaml.NewEncoder(os.Stdout).Encode(items); err != nil {
+		return err
+	}
+
+	// A dry run is only a preview of what --push would do, so it must not
+	// advance the state file.
+	if opts.dryRun {
+		return nil
+	}
+	return saveState(opts.stateFile, currState)
+}
 
-	return yaml.NewEncoder(os.Stdout).Encode(items)
+// registryParent returns the registry parent resource used to name
+// deletions and, when pushing, to apply upserts.
+func registryParent(opts *options, client common.ApigeeClient) string {
+	project := opts.project
+	if project == "" {
+		project = client.Org()
+	}
+	return fmt.Sprintf("projects/%s/locations/global", project)
+}
+
+// newRegistryClient opens a client for the active registry configuration.
+func newRegistryClient(ctx context.Context) (connection.RegistryClient, error) {
+	settings, err := connection.ActiveConfig()
+	if err != nil {
+		return nil, err
+	}
+	return connection.NewRegistryClientWithSettings(ctx, settings)
+}
+
+// pushApis upserts each api, along with its nested deployments and
+// artifacts, directly into the given registry project, mirroring what
+// `registry apply -f` does for a single resource at a time. It returns the
+// set of api names (by models.Metadata.Name) that failed to push, so the
+// caller can avoid advancing their state and retry them on the next run.
+func pushApis(ctx context.Context, project string, apis []*models.Api) (map[string]bool, error) {
+	client, err := newRegistryClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	failed := map[string]bool{}
+	parent := fmt.Sprintf("projects/%s/locations/global", project)
+	for _, api := range apis {
+		b, err := yaml.Marshal(api)
+		if err != nil {
+			log.Errorf(ctx, "failed to marshal %s: %s", api.Metadata.Name, err)
+			failed[api.Metadata.Name] = true
+			continue
+		}
+		if err := patch.ApplyApiPatchBytes(ctx, client, b, parent); err != nil {
+			log.Errorf(ctx, "failed to push %s: %s", api.Metadata.Name, err)
+			failed[api.Metadata.Name] = true
+			continue
+		}
+		log.Infof(ctx, "pushed %s", api.Metadata.Name)
+	}
+	return failed, nil
+}
+
+// deleteResources removes the registry apis and deployments at the given
+// names, used to reconcile resources that disappeared from Apigee since the
+// previous run. Deployment resource names (".../apis/{api}/deployments/{dep}")
+// are routed to the deployment delete RPC rather than the api one. It
+// returns the subset of names that failed to delete, so the caller can keep
+// retrying them on subsequent runs instead of losing track of them.
+func deleteResources(ctx context.Context, project string, names []string) ([]string, error) {
+	client, err := newRegistryClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	var failed []string
+	for _, name := range names {
+		var err error
+		if strings.Contains(name, "/deployments/") {
+			err = client.DeleteApiDeployment(ctx, &rpc.DeleteApiDeploymentRequest{Name: name, Force: true})
+		} else {
+			err = client.DeleteApi(ctx, &rpc.DeleteApiRequest{Name: name, Force: true})
+		}
+		if err != nil {
+			log.Errorf(ctx, "failed to delete %s: %s", name, err)
+			failed = append(failed, name)
+			continue
+		}
+		log.Infof(ctx, "deleted %s", name)
+	}
+	return failed, nil
 }
 
 // product -> proxies -> deployments
-func addDeployments(ctx context.Context, client common.ApigeeClient, apisByProxy map[string][]*models.Api) error {
-	if len(apisByProxy) == 0 {
+func addDeployments(ctx context.Context, client common.ApigeeClient, apisByProxy map[string][]*models.Api, knownProxies map[string]bool, opts *options, currState *state) error {
+	if len(apisByProxy) == 0 && len(knownProxies) == 0 {
 		return nil
 	}
 	ps, err := client.Proxies(ctx)
@@ -186,6 +378,9 @@ func addDeployments(ctx context.Context, client common.ApigeeClient, apisByProxy
 		return err
 	}
 
+	environments := map[string]*apigee.GoogleCloudApigeeV1Environment{}
+	bundles := map[string][]byte{} // proxy/revision -> downloaded bundle, fetched at most once
+	bundled := map[string]bool{}   // api name + proxy/revision -> artifacts already attached
 	for _, dep := range deps {
 		hostnames, ok := envMap.Hostnames(dep.Environment)
 		if !ok {
@@ -193,26 +388,55 @@ func addDeployments(ctx context.Context, client common.ApigeeClient, apisByProxy
 			continue
 		}
 
+		env, ok := environments[dep.Environment]
+		if !ok {
+			var err error
+			env, err = client.Environment(ctx, dep.Environment)
+			if err != nil {
+				// The deployment itself is still live; only the
+				// deploymentType/apiProxyType annotations are lost.
+				log.Warnf(ctx, "failed to fetch environment %s, continuing without deployment/proxy type annotations: %s", dep.Environment, err)
+			}
+			environments[dep.Environment] = env
+		}
+		if env != nil && env.DeploymentType == "ARCHIVE" {
+			// Archive deployments have no proxy revision and aren't bound to
+			// a product's proxy list, so they'd otherwise trip the
+			// "unknown product" warning below.
+			log.Debugf(ctx, "skipping archive deployment %q in environment %s", dep.ApiProxy, dep.Environment)
+			continue
+		}
+
 		for _, hostname := range hostnames {
 			apis, ok := apisByProxy[dep.ApiProxy]
 			if !ok || len(apis) == 0 {
-				log.Warnf(ctx, "unknown product: %q for deployment: %#v", dep.ApiProxy, dep)
+				// A proxy bound to an unchanged product has no api to
+				// attach to here but is still accounted for, so only warn
+				// when it isn't bound to any current product at all.
+				if !knownProxies[dep.ApiProxy] {
+					log.Warnf(ctx, "unknown product: %q for deployment: %#v", dep.ApiProxy, dep)
+				}
 				continue
 			}
 
 			for _, api := range apis {
 				envgroup, _ := envMap.Envgroup(hostname)
+				annotations := map[string]string{
+					"apigee-proxy-revision": fmt.Sprintf("organizations/%s/apis/%s/revisions/%s", client.Org(), dep.ApiProxy, dep.Revision),
+					"apigee-environment":    fmt.Sprintf("organizations/%s/environments/%s", client.Org(), dep.Environment),
+					"apigee-envgroup":       envgroup,
+				}
+				if env != nil {
+					annotations["apigee-deployment-type"] = env.DeploymentType
+					annotations["apigee-api-proxy-type"] = env.ApiProxyType
+				}
 				deployment := &models.ApiDeployment{
 					Header: models.Header{
 						ApiVersion: patch.RegistryV1,
 						Kind:       "Deployment",
 						Metadata: models.Metadata{
-							Name: common.Label(hostname),
-							Annotations: map[string]string{
-								"apigee-proxy-revision": fmt.Sprintf("organizations/%s/apis/%s/revisions/%s", client.Org(), dep.ApiProxy, dep.Revision),
-								"apigee-environment":    fmt.Sprintf("organizations/%s/environments/%s", client.Org(), dep.Environment),
-								"apigee-envgroup":       envgroup,
-							},
+							Name:        common.Label(hostname),
+							Annotations: annotations,
 						},
 					},
 					Data: models.ApiDeploymentData{
@@ -221,6 +445,35 @@ func addDeployments(ctx context.Context, client common.ApigeeClient, apisByProxy
 						EndpointURI: fmt.Sprintf("https://%s/%s", hostname, dep.ApiProxy),
 					},
 				}
+				if opts.includeBundles {
+					revisionKey := dep.ApiProxy + "/" + dep.Revision
+					bundledKey := api.Metadata.Name + "/" + revisionKey
+					if !bundled[bundledKey] {
+						bundle, ok := bundles[revisionKey]
+						if !ok {
+							var err error
+							bundle, err = client.ProxyBundle(ctx, dep.ApiProxy, dep.Revision)
+							if err != nil {
+								log.Warnf(ctx, "failed to fetch bundle for %s revision %s: %s", dep.ApiProxy, dep.Revision, err)
+							}
+							bundles[revisionKey] = bundle
+						}
+						if bundle != nil {
+							if err := addBundleArtifacts(ctx, client, bundle, api, dep.ApiProxy, dep.Revision, opts); err != nil {
+								log.Warnf(ctx, "failed to attach bundle artifacts for %s revision %s: %s", dep.ApiProxy, dep.Revision, err)
+							}
+						}
+						bundled[bundledKey] = true
+					}
+				}
+
+				if ps, ok := currState.Products[api.Metadata.Name]; ok {
+					if ps.Deployments == nil {
+						ps.Deployments = map[string]string{}
+					}
+					ps.Deployments[deployment.Metadata.Name] = deploymentHash(dep.ApiProxy, dep.Revision, dep.Environment)
+				}
+
 				api.Data.ApiDeployments = append(api.Data.ApiDeployments, deployment)
 			}
 		}
@@ -228,6 +481,116 @@ func addDeployments(ctx context.Context, client common.ApigeeClient, apisByProxy
 	return nil
 }
 
+// addBundleArtifacts attaches an ApiSpec artifact for any OpenAPI/GraphQL
+// descriptor found in bundle, plus a ProxyBundle artifact, to api. The
+// ProxyBundle artifact holds the bundle as base64, or, when a GCS bucket is
+// set, the bundle's sha256 checksum and its gs:// URL.
+func addBundleArtifacts(ctx context.Context, client common.ApigeeClient, bundle []byte, api *models.Api, proxy, revision string, opts *options) error {
+	if spec, specKind, err := findBundleSpec(bundle); err != nil {
+		log.Warnf(ctx, "failed to inspect bundle for %s revision %s: %s", proxy, revision, err)
+	} else if spec != nil {
+		contents, err := specContents(specKind, spec)
+		if err != nil {
+			log.Warnf(ctx, "failed to compress spec for %s revision %s: %s", proxy, revision, err)
+		} else {
+			api.Data.Artifacts = append(api.Data.Artifacts, &models.Artifact{
+				Header: models.Header{
+					ApiVersion: patch.RegistryV1,
+					Kind:       "ApiSpec",
+					Metadata: models.Metadata{
+						Name: fmt.Sprintf("%s-%s-%s", proxy, revision, specKind),
+					},
+				},
+				Data: models.ApiSpecData{
+					MimeType: specMimeType(specKind),
+					Contents: contents,
+				},
+			})
+		}
+	}
+
+	bundleArtifact := &models.Artifact{
+		Header: models.Header{
+			ApiVersion: patch.RegistryV1,
+			Kind:       "ProxyBundle",
+			Metadata: models.Metadata{
+				Name: fmt.Sprintf("%s-%s-bundle", proxy, revision),
+			},
+		},
+	}
+	if opts.bundleGCSBucket != "" {
+		sum := sha256.Sum256(bundle)
+		gcsURL, err := common.UploadGCS(ctx, opts.bundleGCSBucket, fmt.Sprintf("%s/%s/%s.zip", client.Org(), proxy, revision), bundle)
+		if err != nil {
+			return err
+		}
+		bundleArtifact.Data = models.ArtifactData{
+			"checksum": fmt.Sprintf("sha256:%x", sum),
+			"uri":      gcsURL,
+		}
+	} else {
+		bundleArtifact.Data = models.ArtifactData{
+			"contents": base64.StdEncoding.EncodeToString(bundle),
+		}
+	}
+	api.Data.Artifacts = append(api.Data.Artifacts, bundleArtifact)
+	return nil
+}
+
+// findBundleSpec looks for an OpenAPI or GraphQL descriptor under
+// resources/oas or resources/graphql in a proxy bundle and returns its raw
+// contents along with a kind of "oas" or "graphql".
+func findBundleSpec(bundle []byte) ([]byte, string, error) {
+	r, err := zip.NewReader(bytes.NewReader(bundle), int64(len(bundle)))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, kind := range []string{"oas", "graphql"} {
+		prefix := "resources/" + kind + "/"
+		for _, f := range r.File {
+			if f.FileInfo().IsDir() || !strings.HasPrefix(f.Name, prefix) {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, "", err
+			}
+			contents, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return nil, "", err
+			}
+			return contents, kind, nil
+		}
+	}
+	return nil, "", nil
+}
+
+func specMimeType(kind string) string {
+	if kind == "graphql" {
+		return "application/graphql"
+	}
+	return "application/x.openapi+gzip;version=3.0.0"
+}
+
+// specContents prepares a discovered spec for storage as ApiSpecData
+// Contents, gzip-compressing it to match the "+gzip" mimetype specMimeType
+// advertises for the oas kind. Other kinds are stored uncompressed.
+func specContents(kind string, spec []byte) ([]byte, error) {
+	if kind != "oas" {
+		return spec, nil
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(spec); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func boundProxies(prod *apigee.GoogleCloudApigeeV1ApiProduct) []string {
 	proxies := prod.Proxies
 	for _, oc := range prod.OperationGroup.OperationConfigs {
@@ -0,0 +1,124 @@
+// Copyright 2023 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package products
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+)
+
+// buildBundle returns a zip archive containing files, mapping archive path
+// to contents, mimicking the layout of a downloaded Apigee proxy bundle.
+func buildBundle(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, contents := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatalf("failed to add %s to test bundle: %s", name, err)
+		}
+		if _, err := f.Write([]byte(contents)); err != nil {
+			t.Fatalf("failed to write %s to test bundle: %s", name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close test bundle: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestFindBundleSpec(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        map[string]string
+		wantContents string
+		wantKind     string
+	}{
+		{
+			name:         "oas spec",
+			files:        map[string]string{"resources/oas/openapi.yaml": "openapi: 3.0.0"},
+			wantContents: "openapi: 3.0.0",
+			wantKind:     "oas",
+		},
+		{
+			name:         "graphql spec",
+			files:        map[string]string{"resources/graphql/schema.graphql": "type Query {}"},
+			wantContents: "type Query {}",
+			wantKind:     "graphql",
+		},
+		{
+			name:     "no spec present",
+			files:    map[string]string{"apiproxy/helloworld.xml": "<APIProxy/>"},
+			wantKind: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle := buildBundle(t, tt.files)
+			spec, kind, err := findBundleSpec(bundle)
+			if err != nil {
+				t.Fatalf("findBundleSpec() returned error: %s", err)
+			}
+			if kind != tt.wantKind {
+				t.Errorf("findBundleSpec() kind = %q, want %q", kind, tt.wantKind)
+			}
+			if tt.wantKind == "" {
+				if spec != nil {
+					t.Errorf("findBundleSpec() spec = %q, want nil", spec)
+				}
+				return
+			}
+			if string(spec) != tt.wantContents {
+				t.Errorf("findBundleSpec() spec = %q, want %q", spec, tt.wantContents)
+			}
+		})
+	}
+}
+
+func TestSpecContents(t *testing.T) {
+	t.Run("oas is gzip-compressed to match specMimeType", func(t *testing.T) {
+		spec := []byte("openapi: 3.0.0")
+		contents, err := specContents("oas", spec)
+		if err != nil {
+			t.Fatalf("specContents() returned error: %s", err)
+		}
+		r, err := gzip.NewReader(bytes.NewReader(contents))
+		if err != nil {
+			t.Fatalf("specContents() did not return gzip-compressed data: %s", err)
+		}
+		decompressed, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("failed to decompress specContents() output: %s", err)
+		}
+		if string(decompressed) != string(spec) {
+			t.Errorf("decompressed specContents() = %q, want %q", decompressed, spec)
+		}
+	})
+
+	t.Run("graphql is left uncompressed to match specMimeType", func(t *testing.T) {
+		spec := []byte("type Query {}")
+		contents, err := specContents("graphql", spec)
+		if err != nil {
+			t.Fatalf("specContents() returned error: %s", err)
+		}
+		if string(contents) != string(spec) {
+			t.Errorf("specContents() = %q, want %q unchanged", contents, spec)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package products
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/apigee/registry-experimental/cmd/registry-connect/discover/apigee/common"
+	"gopkg.in/yaml.v3"
+)
+
+// state records enough of a previous run's view of Apigee to support
+// incremental export: products, proxy revisions, and deployments that
+// haven't changed since the last run are skipped, and anything that
+// disappeared from Apigee is reported as a deletion.
+type state struct {
+	Org      string                   `yaml:"org"`
+	Products map[string]*productState `yaml:"products"`
+	// PendingDeletions holds registry resource names that were identified
+	// for reconciliation but failed to delete on a previous run, so they
+	// keep being retried instead of silently falling out of tracking.
+	PendingDeletions []string `yaml:"pendingDeletions,omitempty"`
+}
+
+type productState struct {
+	LastModifiedAt int64             `yaml:"lastModifiedAt"`
+	Deployments    map[string]string `yaml:"deployments,omitempty"` // deployment name -> hash of proxy/revision/environment
+	// DeploymentHashes is the sorted set of deploymentHash values for every
+	// raw Apigee deployment bound to this product's proxies, used to detect
+	// whether anything changed since the last run. Unlike Deployments, this
+	// has exactly one entry per Apigee deployment regardless of how many
+	// hostnames (and therefore registry Deployment resources) it maps to.
+	DeploymentHashes []string `yaml:"deploymentHashes,omitempty"`
+}
+
+// loadState reads the state file at path, returning an empty state if path
+// is unset or the file doesn't exist yet.
+func loadState(path string) (*state, error) {
+	s := &state{Products: map[string]*productState{}}
+	if path == "" {
+		return s, nil
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := yaml.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	if s.Products == nil {
+		s.Products = map[string]*productState{}
+	}
+	return s, nil
+}
+
+// saveState writes state to path. It is a no-op if path is unset.
+func saveState(path string, s *state) error {
+	if path == "" {
+		return nil
+	}
+	b, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// deploymentHash fingerprints the tuple that determines whether a
+// deployment has changed since the last run.
+func deploymentHash(proxy, revision, environment string) string {
+	sum := sha256.Sum256([]byte(proxy + "|" + revision + "|" + environment))
+	return fmt.Sprintf("%x", sum)
+}
+
+// deletedApis returns the registry resource names, under parent, of
+// products present in prev but no longer present in curr.
+func deletedApis(parent string, prev, curr *state) []string {
+	var names []string
+	for name := range prev.Products {
+		if _, ok := curr.Products[name]; !ok {
+			names = append(names, fmt.Sprintf("%s/apis/%s", parent, name))
+		}
+	}
+	return names
+}
+
+// deletedDeployments returns the registry resource names, under parent, of
+// deployments that disappeared from a still-present product since prev.
+// Products that are entirely new or entirely gone are skipped here since
+// deletedApis already accounts for the whole api in the latter case.
+func deletedDeployments(parent string, prev, curr *state) []string {
+	var names []string
+	for name, currProduct := range curr.Products {
+		prevProduct, ok := prev.Products[name]
+		if !ok {
+			continue
+		}
+		for depName := range prevProduct.Deployments {
+			if _, ok := currProduct.Deployments[depName]; !ok {
+				names = append(names, fmt.Sprintf("%s/apis/%s/deployments/%s", parent, name, depName))
+			}
+		}
+	}
+	return names
+}
+
+// dedupStrings returns ss with duplicate values removed, preserving the
+// order of first occurrence.
+func dedupStrings(ss []string) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, s := range ss {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		out = append(out, s)
+	}
+	return out
+}
+
+// deploymentHashesByProxy fingerprints every current deployment, grouped by
+// the proxy it deploys, so callers can tell whether any deployment bound to
+// a product's proxies has changed since the last run.
+func deploymentHashesByProxy(ctx context.Context, client common.ApigeeClient) (map[string][]string, error) {
+	deps, err := client.Deployments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	hashes := map[string][]string{}
+	for _, dep := range deps {
+		hashes[dep.ApiProxy] = append(hashes[dep.ApiProxy], deploymentHash(dep.ApiProxy, dep.Revision, dep.Environment))
+	}
+	return hashes, nil
+}
+
+// deploymentHashesForProxies flattens and sorts the deployment hashes bound
+// to the given proxies, for comparison against a previous run's state.
+func deploymentHashesForProxies(proxies []string, byProxy map[string][]string) []string {
+	var hashes []string
+	for _, p := range proxies {
+		hashes = append(hashes, byProxy[p]...)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// equalDeploymentHashes reports whether prev and current, both already
+// sorted, hold the same set of raw deployment hashes.
+func equalDeploymentHashes(prev, current []string) bool {
+	if len(prev) != len(current) {
+		return false
+	}
+	for i, h := range prev {
+		if h != current[i] {
+			return false
+		}
+	}
+	return true
+}
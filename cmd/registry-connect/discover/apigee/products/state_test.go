@@ -0,0 +1,143 @@
+// Copyright 2023 Google LLC. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package products
+
+import "testing"
+
+func TestDeploymentHash(t *testing.T) {
+	a := deploymentHash("helloworld", "2", "test")
+	b := deploymentHash("helloworld", "2", "test")
+	if a != b {
+		t.Errorf("deploymentHash is not deterministic: %q != %q", a, b)
+	}
+
+	c := deploymentHash("helloworld", "3", "test")
+	if a == c {
+		t.Errorf("deploymentHash(helloworld, 2, test) == deploymentHash(helloworld, 3, test): %q", a)
+	}
+}
+
+func TestEqualDeploymentHashes(t *testing.T) {
+	tests := []struct {
+		name     string
+		prev     []string
+		current  []string
+		expected bool
+	}{
+		{"both empty", nil, nil, true},
+		{"identical", []string{"a", "b"}, []string{"a", "b"}, true},
+		{
+			name: "same deployment, multiple hostnames does not multiply the raw hash list",
+			// deploymentHashesForProxies produces one hash per Apigee
+			// deployment regardless of how many hostnames it routes
+			// through, so both sides here have exactly one entry.
+			prev:     []string{deploymentHash("helloworld", "2", "test")},
+			current:  []string{deploymentHash("helloworld", "2", "test")},
+			expected: true,
+		},
+		{"different length", []string{"a"}, []string{"a", "b"}, false},
+		{"different values", []string{"a", "b"}, []string{"a", "c"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := equalDeploymentHashes(tt.prev, tt.current); got != tt.expected {
+				t.Errorf("equalDeploymentHashes(%v, %v) = %v, want %v", tt.prev, tt.current, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestDedupStrings(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       []string
+		expected []string
+	}{
+		{"no duplicates", []string{"a", "b"}, []string{"a", "b"}},
+		{"duplicates collapsed, order preserved", []string{"a", "b", "a", "c", "b"}, []string{"a", "b", "c"}},
+		{"empty", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dedupStrings(tt.in)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("dedupStrings(%v) = %v, want %v", tt.in, got, tt.expected)
+			}
+			for i := range got {
+				if got[i] != tt.expected[i] {
+					t.Errorf("dedupStrings(%v) = %v, want %v", tt.in, got, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestDeletedApis(t *testing.T) {
+	prev := &state{Products: map[string]*productState{
+		"kept":    {},
+		"removed": {},
+	}}
+	curr := &state{Products: map[string]*productState{
+		"kept": {},
+	}}
+
+	got := deletedApis("projects/myorg/locations/global", prev, curr)
+	want := []string{"projects/myorg/locations/global/apis/removed"}
+	if len(got) != len(want) || got[0] != want[0] {
+		t.Errorf("deletedApis() = %v, want %v", got, want)
+	}
+}
+
+func TestDeletedDeployments(t *testing.T) {
+	prev := &state{Products: map[string]*productState{
+		"stable": {Deployments: map[string]string{
+			"test-kept":    "hash1",
+			"test-removed": "hash2",
+		}},
+		"gone-entirely": {Deployments: map[string]string{
+			"test-also-gone": "hash3",
+		}},
+	}}
+	curr := &state{Products: map[string]*productState{
+		"stable": {Deployments: map[string]string{
+			"test-kept": "hash1",
+		}},
+		// "gone-entirely" is absent from curr: deletedApis, not
+		// deletedDeployments, is responsible for that case.
+	}}
+
+	got := deletedDeployments("projects/myorg/locations/global", prev, curr)
+	want := "projects/myorg/locations/global/apis/stable/deployments/test-removed"
+	if len(got) != 1 || got[0] != want {
+		t.Errorf("deletedDeployments() = %v, want [%s]", got, want)
+	}
+}
+
+func TestDeploymentHashesForProxies(t *testing.T) {
+	byProxy := map[string][]string{
+		"helloworld":       {"h2"},
+		"helloworld-admin": {"h1", "h3"},
+	}
+	got := deploymentHashesForProxies([]string{"helloworld", "helloworld-admin"}, byProxy)
+	want := []string{"h1", "h2", "h3"}
+	if len(got) != len(want) {
+		t.Fatalf("deploymentHashesForProxies() = %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("deploymentHashesForProxies() = %v, want %v", got, want)
+		}
+	}
+}